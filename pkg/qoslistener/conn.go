@@ -2,9 +2,10 @@ package qoslistener
 
 import (
 	"context"
-	"io"
 	"net"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"golang.org/x/time/rate"
 )
@@ -22,107 +23,207 @@ type inConn = net.Conn
 // qosconn struct implements net.Conn interface. Connection of qosconn type cannot be created directly
 // outside of this package.
 //
-// It wraps other net.Conn connection that will be rate limited on Read() and Write() operations.
-// Rate limiting is backed with rate.Limiter taken from "golang.org/x/time/rate". rate.Limiter implements
-// token bucket algorithm.
-// qosconn treats 1 token as a one available byte of bandwidth.
+// It wraps other net.Conn connection that will be rate limited on Read() and Write() operations. Rate
+// limiting itself is delegated to a LimitedReader/LimitedWriter pair (see limited.go), fed with whichever
+// chain of rate.Limiter applies to the connection at the time of the call:
+// - pcReadLimiter/pcWriteLimiter are per-connection rate limiters and are independent per connection. Access
+//   here is not synchronized.
+// - the connection's group limiter (if any), looked up by groupName on every call since groups are created
+//   lazily and can be retargeted at runtime via SetGroupLimits.
+// - parent's globalReadLimiter/globalWriteLimiter are per-listener rate limiters and are shared between
+//   different connections.
 //
-// There are two rate.Limiter instances used within each qosconn:
-// - pcLimiter which is per-connection rate limiter and is independent per connection. Access here is not synchronized.
-// - parent (.globalLimiter) which is per-listener rate limiter and is shared between different connections. That one is
-//   synchronized in parent (instance of QoSListener)
+// A qosconn additionally carries the groupName it was classified under at Accept time (see GroupClassifier)
+// and whether it was classified as LAN traffic, both of which are fixed for the lifetime of the connection.
 type qosconn struct {
 	inConn
 
-	parent      *QoSListener
-	pcLimiter   *rate.Limiter
-	pcBandwidth int32
+	parent           *QoSListener
+	pcReadLimiter    *rate.Limiter
+	pcWriteLimiter   *rate.Limiter
+	pcReadBandwidth  int32
+	pcWriteBandwidth int32
+
+	readLimited  *LimitedReader
+	writeLimited *LimitedWriter
+
+	groupName string
+	isLAN     bool
+
+	bytesRead    uint64
+	bytesWritten uint64
+	lastActivity int64 // unix nanoseconds, accessed atomically
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	deadlineMutex sync.RWMutex
+	readDeadline  time.Time
+	writeDeadline time.Time
 }
 
-func newConn(conn net.Conn, parent *QoSListener, pcBandwidth int32) *qosconn {
+func newConn(conn net.Conn, parent *QoSListener, pcReadBandwidth, pcWriteBandwidth int32, groupName string, isLAN bool) *qosconn {
+	ctx, cancel := context.WithCancel(parent.shutdownCtx)
 	return &qosconn{
-		inConn:      conn,
-		parent:      parent,
-		pcBandwidth: pcBandwidth,
-		pcLimiter:   rate.NewLimiter(findLimit(int(pcBandwidth)), findBurst(int(pcBandwidth))),
+		inConn:           conn,
+		parent:           parent,
+		pcReadBandwidth:  pcReadBandwidth,
+		pcWriteBandwidth: pcWriteBandwidth,
+		pcReadLimiter:    rate.NewLimiter(findLimit(int(pcReadBandwidth)), findBurst(int(pcReadBandwidth))),
+		pcWriteLimiter:   rate.NewLimiter(findLimit(int(pcWriteBandwidth)), findBurst(int(pcWriteBandwidth))),
+		readLimited:      NewLimitedReader(conn),
+		writeLimited:     NewLimitedWriter(conn),
+		groupName:        groupName,
+		isLAN:            isLAN,
+		ctx:              ctx,
+		cancel:           cancel,
 	}
 }
 
-func (c *qosconn) updateRateLimiter(bandwidth int32) {
-	c.pcLimiter.SetLimit(findLimit(int(bandwidth)))
-	c.pcLimiter.SetBurst(findBurst(int(bandwidth)))
+// BytesRead returns the number of bytes read from this connection so far.
+func (c *qosconn) BytesRead() uint64 {
+	return atomic.LoadUint64(&c.bytesRead)
 }
 
-func (c *qosconn) Read(b []byte) (int, error) {
-	return c.rateLimitOperation(b, opRead)
+// BytesWritten returns the number of bytes written to this connection so far.
+func (c *qosconn) BytesWritten() uint64 {
+	return atomic.LoadUint64(&c.bytesWritten)
 }
 
-func (c *qosconn) Write(b []byte) (int, error) {
-	return c.rateLimitOperation(b, opWrite)
+// LastActivity returns the time of the last successful Read or Write on this connection, or the zero
+// time.Time if none has completed yet.
+func (c *qosconn) LastActivity() time.Time {
+	nanos := atomic.LoadInt64(&c.lastActivity)
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// Close cancels the connection's context - unblocking any goroutine waiting in a rate limiter - closes the
+// underlying connection, and folds its final byte counts into the parent listener's totals.
+func (c *qosconn) Close() error {
+	c.cancel()
+	c.parent.untrackConn(c)
+	return c.inConn.Close()
 }
 
-func (c *qosconn) findBufferSize(connectionLimiter, globalLimiter *rate.Limiter, initial int) int {
-	bufferSize := initial
-	connectionLimiterFraction := connectionLimiter.Burst()
-	if connectionLimiter.Limit() != rate.Inf && connectionLimiter.Burst() == 0 {
-		return 0
+// SetReadDeadline sets the deadline applied to the rate limiter waits of future Read calls, in addition to
+// the underlying connection's own read deadline.
+func (c *qosconn) SetReadDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	c.readDeadline = t
+	c.deadlineMutex.Unlock()
+	return c.inConn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline applied to the rate limiter waits of future Write calls, in addition to
+// the underlying connection's own write deadline.
+func (c *qosconn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	c.writeDeadline = t
+	c.deadlineMutex.Unlock()
+	return c.inConn.SetWriteDeadline(t)
+}
+
+// deadlineFor returns the deadline currently configured for op's direction, or the zero time.Time if none
+// has been set via SetReadDeadline/SetWriteDeadline.
+func (c *qosconn) deadlineFor(op operation) time.Time {
+	c.deadlineMutex.RLock()
+	defer c.deadlineMutex.RUnlock()
+	if op == opRead {
+		return c.readDeadline
 	}
-	if connectionLimiter.Limit() != rate.Inf && bufferSize > connectionLimiter.Burst() {
-		bufferSize = connectionLimiterFraction
+	return c.writeDeadline
+}
+
+// operationContext derives the context used for a single Read/Write call: the connection's own context,
+// cancelled by Close and by QoSListener.Shutdown, additionally bounded by any deadline set via
+// SetReadDeadline/SetWriteDeadline. The returned cancel func should be called once the call completes.
+func (c *qosconn) operationContext(op operation) (context.Context, context.CancelFunc) {
+	deadline := c.deadlineFor(op)
+	if deadline.IsZero() {
+		return c.ctx, func() {}
 	}
-	globalLimiterFraction := globalLimiter.Burst() / 10000
-	if globalLimiter.Limit() != rate.Inf && globalLimiter.Burst() == 0 {
-		return 0
+	return context.WithDeadline(c.ctx, deadline)
+}
+
+func (c *qosconn) updateRateLimiter(readBandwidth, writeBandwidth int32) {
+	c.pcReadLimiter.SetLimit(findLimit(int(readBandwidth)))
+	c.pcReadLimiter.SetBurst(findBurst(int(readBandwidth)))
+	c.pcWriteLimiter.SetLimit(findLimit(int(writeBandwidth)))
+	c.pcWriteLimiter.SetBurst(findBurst(int(writeBandwidth)))
+}
+
+// refreshBandwidth picks up per-connection bandwidth changes made via QoSListener.SetLimits/
+// SetDirectionalLimits after this connection was accepted.
+func (c *qosconn) refreshBandwidth() {
+	readBandwidth := atomic.LoadInt32(&c.parent.pcReadBandwidth)
+	writeBandwidth := atomic.LoadInt32(&c.parent.pcWriteBandwidth)
+	if readBandwidth != c.pcReadBandwidth || writeBandwidth != c.pcWriteBandwidth {
+		c.pcReadBandwidth = readBandwidth
+		c.pcWriteBandwidth = writeBandwidth
+		c.updateRateLimiter(c.pcReadBandwidth, c.pcWriteBandwidth)
 	}
-	if globalLimiter.Limit() != rate.Inf && bufferSize > globalLimiterFraction {
-		bufferSize = globalLimiterFraction
+}
+
+// directionLimiters returns the per-connection limiter and the parent's current global limiter that apply to
+// op. The global limiter is loaded from its atomic.Pointer, so a concurrent SetDirectionalLimits call never
+// blocks this read.
+func (c *qosconn) directionLimiters(op operation) (pcLimiter, globalLimiter *rate.Limiter) {
+	if op == opRead {
+		return c.pcReadLimiter, c.parent.globalReadLimiter.Load()
 	}
-	if bufferSize == 1 {
-		bufferSize = 64
+	return c.pcWriteLimiter, c.parent.globalWriteLimiter.Load()
+}
+
+// limiterChain builds the ordered chain of limiters a single Read/Write waits on: the per-connection limiter
+// always applies; the group limiter (if the connection was classified into one) and the global limiter apply
+// unless the connection was classified as LAN traffic and SetLANExempt is enabled.
+func (c *qosconn) limiterChain(op operation) []*rate.Limiter {
+	pcLimiter, globalLimiter := c.directionLimiters(op)
+	if c.isLAN {
+		return []*rate.Limiter{pcLimiter}
 	}
-	if initial < bufferSize {
-		bufferSize = initial
+	chain := []*rate.Limiter{pcLimiter}
+	if groupLimiter := c.parent.groupLimiter(c.groupName, op); groupLimiter != nil {
+		chain = append(chain, groupLimiter)
 	}
-	return bufferSize
-}
-
-func (c *qosconn) rateLimitOperation(b []byte, op operation) (int, error) {
-	var connErr error
-	processed := 0
-	for processed < len(b) && connErr != io.EOF {
-		// verify if connection bandwidth has changed and create new rate limiter if needed
-		parentBandwidth := atomic.LoadInt32(&c.parent.pcBandwidth)
-		if parentBandwidth != c.pcBandwidth {
-			c.pcBandwidth = parentBandwidth
-			c.updateRateLimiter(c.pcBandwidth)
-		}
+	return append(chain, globalLimiter)
+}
 
-		c.parent.lockLim()
-		start := processed
-		bufferSize := c.findBufferSize(c.pcLimiter, c.parent.globalLimiter, len(b)-processed)
-		err := c.parent.globalLimiter.WaitN(context.Background(), bufferSize)
-		if err != nil {
-			return 0, err
-		}
-		c.parent.unlockLim()
-		err = c.pcLimiter.WaitN(context.Background(), bufferSize)
-		if err != nil {
-			return 0, err
-		}
+func (c *qosconn) Read(b []byte) (int, error) {
+	return c.doIO(b, opRead)
+}
+
+func (c *qosconn) Write(b []byte) (int, error) {
+	return c.doIO(b, opWrite)
+}
+
+func (c *qosconn) doIO(b []byte, op operation) (int, error) {
+	c.refreshBandwidth()
 
-		var n int
+	ctx, cancel := c.operationContext(op)
+	defer cancel()
+
+	var n int
+	var err error
+	if op == opRead {
+		c.readLimited.SetLimiters(c.limiterChain(op))
+		n, err = c.readLimited.ReadContext(ctx, b)
+	} else {
+		c.writeLimited.SetLimiters(c.limiterChain(op))
+		n, err = c.writeLimited.WriteContext(ctx, b)
+	}
+
+	if n > 0 {
+		atomic.StoreInt64(&c.lastActivity, time.Now().UnixNano())
 		switch op {
 		case opWrite:
-			n, connErr = c.inConn.Write(b[start : start+bufferSize])
+			atomic.AddUint64(&c.bytesWritten, uint64(n))
 		case opRead:
-			buffer := make([]byte, bufferSize)
-			n, connErr = c.inConn.Read(buffer)
-			copy(b[start:start+n], buffer[:])
-		}
-		if connErr != nil && connErr != io.EOF {
-			return 0, connErr
+			atomic.AddUint64(&c.bytesRead, uint64(n))
 		}
-		processed += n
 	}
-	return processed, connErr
+	return n, err
 }
@@ -0,0 +1,123 @@
+package qoslistener
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestConn wraps one end of a net.Pipe in a qosconn, with the other end continuously drained so writes
+// into the pipe never block on anything but the configured rate limiters. pcReadBandwidth/pcWriteBandwidth
+// must match whatever was last passed to parent.SetDirectionalLimits, since refreshBandwidth would otherwise
+// immediately overwrite the connection's limiters with the parent's values on the first Read/Write.
+func newTestConn(t *testing.T, parent *QoSListener, pcReadBandwidth, pcWriteBandwidth int32) (*qosconn, net.Conn) {
+	t.Helper()
+	server, client := net.Pipe()
+	go io.Copy(io.Discard, client)
+	qc := newConn(server, parent, pcReadBandwidth, pcWriteBandwidth, "", false)
+	return qc, client
+}
+
+// newTestParent returns a QoSListener with an unlimited global budget and the given per-connection
+// bandwidths, so tests can exercise per-connection limits in isolation.
+func newTestParent(t *testing.T, connRxBps, connTxBps int) *QoSListener {
+	t.Helper()
+	rawListener, err := net.Listen("tcp4", ":0")
+	require.NoError(t, err)
+	t.Cleanup(func() { rawListener.Close() })
+	parent := NewListener(rawListener)
+	parent.SetDirectionalLimits(AllowAllTraffic, AllowAllTraffic, connRxBps, connTxBps)
+	return parent
+}
+
+// TestQosconn_Close_UnblocksInFlightWrite verifies that Close cancels a Write blocked waiting on the
+// per-connection rate limiter, and that the bytes already written in earlier chunks of that same call are
+// preserved in the returned n rather than discarded.
+func TestQosconn_Close_UnblocksInFlightWrite(t *testing.T) {
+	const writeBandwidth = 64 // bytes/sec, also the burst: the first chunk is free, the rest must wait
+	parent := newTestParent(t, AllowAllTraffic, writeBandwidth)
+	qc, _ := newTestConn(t, parent, int32(AllowAllTraffic), writeBandwidth)
+
+	data := make([]byte, 10*writeBandwidth)
+	result := make(chan struct {
+		n   int
+		err error
+	}, 1)
+	go func() {
+		n, err := qc.Write(data)
+		result <- struct {
+			n   int
+			err error
+		}{n, err}
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, qc.Close())
+
+	select {
+	case r := <-result:
+		require.Error(t, r.err)
+		assert.True(t, errors.Is(r.err, context.Canceled), "expected context.Canceled, got %v", r.err)
+		assert.Greater(t, r.n, 0, "bytes written in earlier chunks must not be dropped on cancellation")
+		assert.Less(t, r.n, len(data), "write should not have completed before Close")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not unblock the in-flight Write")
+	}
+}
+
+// TestQosconn_SetWriteDeadline_UnblocksInFlightWrite verifies that a deadline set via SetWriteDeadline bounds
+// a Write blocked waiting on the per-connection rate limiter, independent of Close.
+func TestQosconn_SetWriteDeadline_UnblocksInFlightWrite(t *testing.T) {
+	const writeBandwidth = 64
+	parent := newTestParent(t, AllowAllTraffic, writeBandwidth)
+	qc, _ := newTestConn(t, parent, int32(AllowAllTraffic), writeBandwidth)
+	defer qc.Close()
+
+	require.NoError(t, qc.SetWriteDeadline(time.Now().Add(50*time.Millisecond)))
+
+	data := make([]byte, 10*writeBandwidth)
+	start := time.Now()
+	n, err := qc.Write(data)
+	elapsed := time.Since(start)
+
+	require.Error(t, err)
+	// rate.Limiter.WaitN returns either ctx.Err() (if it actually waited out the cancellation) or its own
+	// "would exceed context deadline" error (if it determined upfront the reservation can't fit before the
+	// deadline), so accept either form rather than requiring errors.Is(err, context.DeadlineExceeded).
+	assert.Contains(t, err.Error(), "deadline", "expected a deadline-related error, got %v", err)
+	assert.Greater(t, n, 0, "bytes written in earlier chunks must not be dropped when the deadline fires")
+	assert.Less(t, elapsed, 2*time.Second, "write should have aborted promptly once the deadline passed")
+}
+
+// TestQoSListener_Shutdown_UnblocksInFlightWrite verifies that Shutdown cancels the shared context every
+// accepted connection derives its own context from, unsticking a Write blocked on a rate limiter wait.
+func TestQoSListener_Shutdown_UnblocksInFlightWrite(t *testing.T) {
+	const writeBandwidth = 64
+	parent := newTestParent(t, AllowAllTraffic, writeBandwidth)
+	qc, _ := newTestConn(t, parent, int32(AllowAllTraffic), writeBandwidth)
+	defer qc.Close()
+
+	data := make([]byte, 10*writeBandwidth)
+	result := make(chan error, 1)
+	go func() {
+		_, err := qc.Write(data)
+		result <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, parent.Shutdown(context.Background()))
+
+	select {
+	case err := <-result:
+		require.Error(t, err)
+		assert.True(t, errors.Is(err, context.Canceled), "expected context.Canceled, got %v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not unblock the in-flight Write")
+	}
+}
@@ -0,0 +1,137 @@
+package qoslistener
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustParseCIDR(t *testing.T, cidr string) *net.IPNet {
+	t.Helper()
+	_, ipNet, err := net.ParseCIDR(cidr)
+	require.NoError(t, err)
+	return ipNet
+}
+
+func TestQoSListener_Classify_UsesConfiguredClassifier(t *testing.T) {
+	l := NewListener(nil)
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	assert.Equal(t, "", l.classify(server), "no classifier configured should leave the connection ungrouped")
+
+	l.SetGroupClassifier(func(net.Conn) string { return "peerA" })
+	assert.Equal(t, "peerA", l.classify(server))
+
+	l.SetGroupClassifier(nil)
+	assert.Equal(t, "", l.classify(server), "clearing the classifier should opt connections back out of grouping")
+}
+
+func TestQoSListener_IsLANConn_RespectsConfiguredCIDRsAndExemptFlag(t *testing.T) {
+	rawListener, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer rawListener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := rawListener.Accept()
+		require.NoError(t, err)
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp4", rawListener.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	server := <-accepted
+	defer server.Close()
+
+	l := NewListener(rawListener)
+	lanCIDR := mustParseCIDR(t, "127.0.0.0/8")
+
+	assert.False(t, l.isLANConn(server), "LAN exemption is disabled until SetLANExempt is called")
+
+	l.SetLANExempt([]*net.IPNet{lanCIDR}, true)
+	assert.True(t, l.isLANConn(server), "127.0.0.1 falls within the configured LAN CIDR")
+
+	l.SetLANExempt([]*net.IPNet{lanCIDR}, false)
+	assert.False(t, l.isLANConn(server), "disabling lanExempt should stop treating matching connections as LAN")
+
+	l.SetLANExempt([]*net.IPNet{mustParseCIDR(t, "10.0.0.0/8")}, true)
+	assert.False(t, l.isLANConn(server), "127.0.0.1 does not fall within an unrelated CIDR")
+}
+
+func TestQoSListener_GroupLimiter_CreatesAndUpdatesNamedLimiters(t *testing.T) {
+	l := NewListener(nil)
+
+	assert.Nil(t, l.groupLimiter("peerA", opRead), "an unconfigured group name has no limiter")
+
+	l.SetGroupLimits("peerA", kilobyte)
+	readLimiter := l.groupLimiter("peerA", opRead)
+	writeLimiter := l.groupLimiter("peerA", opWrite)
+	require.NotNil(t, readLimiter)
+	require.NotNil(t, writeLimiter)
+	assert.NotSame(t, readLimiter, writeLimiter, "read and write directions must have independent limiters")
+	assert.EqualValues(t, kilobyte, readLimiter.Burst())
+	assert.EqualValues(t, kilobyte, writeLimiter.Burst())
+
+	// Reconfiguring the same group name updates the existing limiters in place rather than creating new
+	// ones, so connections already classified into the group pick up the change immediately.
+	l.SetGroupLimits("peerA", 2*kilobyte)
+	assert.Same(t, readLimiter, l.groupLimiter("peerA", opRead))
+	assert.EqualValues(t, 2*kilobyte, readLimiter.Burst())
+
+	assert.Nil(t, l.groupLimiter("peerB", opRead), "other group names remain unaffected")
+}
+
+// TestQoSListener_GroupLimiter_PacesRealWriteAtLowBps sends real bytes through a qosconn classified into a
+// group whose bps is below the ~10KB/s division threshold in computeBufferSize - a realistic per-peer cap.
+// It guards against the group limiter silently stalling the connection forever instead of pacing it: a bug
+// that unit tests of limiter construction alone (TestQoSListener_GroupLimiter_CreatesAndUpdatesNamedLimiters)
+// cannot catch, since it only reproduces once bytes actually flow through the limiter chain.
+func TestQoSListener_GroupLimiter_PacesRealWriteAtLowBps(t *testing.T) {
+	const groupBps = 5000 // below the 10000 division threshold in computeBufferSize
+	const totalBytes = 2 * groupBps
+
+	parent := newTestParent(t, AllowAllTraffic, AllowAllTraffic)
+	parent.SetGroupLimits("peer", groupBps)
+
+	server, client := net.Pipe()
+	defer client.Close()
+	go io.Copy(io.Discard, client)
+	qc := newConn(server, parent, int32(AllowAllTraffic), int32(AllowAllTraffic), "peer", false)
+	defer qc.Close()
+
+	data := make([]byte, totalBytes)
+	result := make(chan struct {
+		n   int
+		err error
+	}, 1)
+	start := time.Now()
+	go func() {
+		n, err := qc.Write(data)
+		result <- struct {
+			n   int
+			err error
+		}{n, err}
+	}()
+
+	select {
+	case r := <-result:
+		elapsed := time.Since(start)
+		require.NoError(t, r.err)
+		require.Equal(t, totalBytes, r.n)
+
+		// The group limiter's burst is pre-filled, so the first groupBps bytes are effectively free; only
+		// the remainder is paced at groupBps bytes/sec.
+		expected := float64(totalBytes-groupBps) / groupBps
+		tolerance := 0.3 * expected
+		assert.InDelta(t, expected, elapsed.Seconds(), tolerance,
+			"measured duration should converge to the group's %d bps cap instead of hanging", groupBps)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write through a low-bps group limiter did not complete - the connection stalled instead of pacing")
+	}
+}
@@ -0,0 +1,190 @@
+package qoslistener
+
+import (
+	"context"
+	"io"
+
+	"golang.org/x/time/rate"
+)
+
+// computeBufferSize picks how many bytes of initial a single rate-limited chunk should cover, given an
+// ordered chain of limiters. The first limiter is treated as a per-stream budget and may use its whole
+// burst; every limiter after it is treated as shared and is capped to a fraction of its burst, so one
+// stream cannot claim an entire shared bucket in one reservation. A shared limiter configured below ~10KB/s
+// still yields a fraction of at least 1 byte rather than collapsing to a 0-byte buffer, since a 0-byte
+// chunk would never advance the stream or wait on the limiter at all - it would just spin. A limiter whose
+// burst is genuinely 0 (as opposed to merely rounding down to 0 once divided) blocks the stream entirely, by
+// design: that's how a bandwidth of exactly 0 is expressed. nil entries are ignored. The result is
+// additionally capped to maxSingleWriteSize, and to the smallest real burst in the chain, so a single
+// Read/Write can never ask a limiter to reserve more tokens than its bucket can ever hold.
+func computeBufferSize(limiters []*rate.Limiter, initial int) int {
+	bufferSize := initial
+	minBurst := -1
+	for i, limiter := range limiters {
+		if limiter == nil {
+			continue
+		}
+		if limiter.Limit() == rate.Inf {
+			continue
+		}
+		burst := limiter.Burst()
+		if burst == 0 {
+			return 0
+		}
+		if minBurst == -1 || burst < minBurst {
+			minBurst = burst
+		}
+		fraction := burst
+		if i > 0 {
+			fraction /= 10000
+			if fraction < 1 {
+				fraction = 1
+			}
+		}
+		if bufferSize > fraction {
+			bufferSize = fraction
+		}
+	}
+	if bufferSize > maxSingleWriteSize {
+		bufferSize = maxSingleWriteSize
+	}
+	if bufferSize == 1 {
+		bufferSize = 64
+	}
+	if minBurst >= 0 && bufferSize > minBurst {
+		bufferSize = minBurst
+	}
+	if initial < bufferSize {
+		bufferSize = initial
+	}
+	return bufferSize
+}
+
+// LimitedReader wraps an io.Reader so every Read waits on an ordered chain of rate.Limiter for the bytes it
+// reads, the same token-bucket engine QoSListener uses for net.Conn. It can be used standalone, outside of a
+// net.Listener, e.g. to rate limit a file, a pipe, or an HTTP request body.
+type LimitedReader struct {
+	reader   io.Reader
+	limiters []*rate.Limiter
+}
+
+// NewLimitedReader returns a LimitedReader that rate limits reads from r against limiters, in order.
+func NewLimitedReader(r io.Reader, limiters ...*rate.Limiter) *LimitedReader {
+	return &LimitedReader{reader: r, limiters: limiters}
+}
+
+// SetLimiters replaces the chain of limiters waited on by future Read calls.
+func (lr *LimitedReader) SetLimiters(limiters []*rate.Limiter) {
+	lr.limiters = limiters
+}
+
+func (lr *LimitedReader) Read(b []byte) (int, error) {
+	return lr.ReadContext(context.Background(), b)
+}
+
+// ReadContext behaves like Read but aborts if ctx is done before the chunk's limiters release it, returning
+// ctx.Err(), or the limiter's own error when it can tell upfront that the wait would outlast ctx's deadline.
+// As required by io.Reader, the returned n always reflects the bytes copied into b before the
+// error occurred, including the chunk whose limiter wait was interrupted - those bytes were already read off
+// the underlying reader and must not be silently dropped from the stream.
+//
+// Unlike Write, Read cannot assume the underlying reader delivers a full chunk: an io.Reader is allowed to
+// return fewer bytes than requested, or 0 with io.EOF. Reserving a full chunk's worth of tokens before
+// reading would permanently over-charge the limiters for bytes that were never actually read, so instead we
+// read the chunk first and only wait on the limiters for the number of bytes actually delivered.
+func (lr *LimitedReader) ReadContext(ctx context.Context, b []byte) (int, error) {
+	var ioErr error
+	processed := 0
+	for processed < len(b) && ioErr != io.EOF {
+		bufferSize := computeBufferSize(lr.limiters, len(b)-processed)
+
+		buffer := make([]byte, bufferSize)
+		n, err := lr.reader.Read(buffer)
+		if n > 0 {
+			copy(b[processed:processed+n], buffer[:n])
+			for _, limiter := range lr.limiters {
+				if limiter == nil {
+					continue
+				}
+				if waitErr := limiter.WaitN(ctx, n); waitErr != nil {
+					return processed + n, waitErr
+				}
+			}
+		}
+		if err != nil && err != io.EOF {
+			return processed + n, err
+		}
+		ioErr = err
+		processed += n
+	}
+	return processed, ioErr
+}
+
+// LimitedWriter wraps an io.Writer so every Write waits on an ordered chain of rate.Limiter before writing,
+// the same token-bucket engine QoSListener uses for net.Conn. It can be used standalone, outside of a
+// net.Listener, e.g. to rate limit a file, a pipe, or an HTTP request body.
+type LimitedWriter struct {
+	writer   io.Writer
+	limiters []*rate.Limiter
+}
+
+// NewLimitedWriter returns a LimitedWriter that rate limits writes to w against limiters, in order.
+func NewLimitedWriter(w io.Writer, limiters ...*rate.Limiter) *LimitedWriter {
+	return &LimitedWriter{writer: w, limiters: limiters}
+}
+
+// SetLimiters replaces the chain of limiters waited on by future Write calls.
+func (lw *LimitedWriter) SetLimiters(limiters []*rate.Limiter) {
+	lw.limiters = limiters
+}
+
+func (lw *LimitedWriter) Write(b []byte) (int, error) {
+	return lw.WriteContext(context.Background(), b)
+}
+
+// WriteContext behaves like Write but aborts if ctx is done before the chunk's limiters release it,
+// returning ctx.Err(), or the limiter's own error when it can tell upfront that the wait would outlast ctx's
+// deadline. As required by io.Writer, the returned n always reflects the bytes already written
+// to the underlying writer before the error occurred, so callers never duplicate data by retrying bytes
+// that were, in fact, already sent.
+func (lw *LimitedWriter) WriteContext(ctx context.Context, b []byte) (int, error) {
+	var ioErr error
+	processed := 0
+	for processed < len(b) && ioErr != io.EOF {
+		bufferSize := computeBufferSize(lw.limiters, len(b)-processed)
+		for _, limiter := range lw.limiters {
+			if limiter == nil {
+				continue
+			}
+			if err := limiter.WaitN(ctx, bufferSize); err != nil {
+				return processed, err
+			}
+		}
+
+		n, err := lw.writer.Write(b[processed : processed+bufferSize])
+		if err != nil && err != io.EOF {
+			return processed + n, err
+		}
+		ioErr = err
+		processed += n
+	}
+	return processed, ioErr
+}
+
+// listenerLimitedReader rate limits r against its parent listener's current global read limiter, re-reading
+// the limiter on every call so it tracks SetLimits/SetDirectionalLimits changes made after construction.
+type listenerLimitedReader struct {
+	parent *QoSListener
+	inner  *LimitedReader
+}
+
+func (r *listenerLimitedReader) Read(b []byte) (int, error) {
+	r.inner.SetLimiters([]*rate.Limiter{r.parent.globalReadLimiter.Load()})
+	return r.inner.Read(b)
+}
+
+// NewLimitedReader returns an io.Reader that rate limits r against this listener's global read budget, so
+// non-net.Conn streams (files, pipes, HTTP bodies, QUIC streams, ...) can share it with accepted connections.
+func (l *QoSListener) NewLimitedReader(r io.Reader) io.Reader {
+	return &listenerLimitedReader{parent: l, inner: NewLimitedReader(r)}
+}
@@ -0,0 +1,114 @@
+package qoslistener
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+// shortReader is an io.Reader that always returns fewer bytes than requested, to exercise the case where
+// the underlying stream delivers less than a chunk's worth of data.
+type shortReader struct {
+	remaining int
+	chunk     int
+}
+
+func (r *shortReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+	n := r.chunk
+	if n > len(p) {
+		n = len(p)
+	}
+	if n > r.remaining {
+		n = r.remaining
+	}
+	r.remaining -= n
+	return n, nil
+}
+
+func TestLimitedReader_ShortReads_ConvergeToConfiguredBandwidth(t *testing.T) {
+	const bps = 10 * kilobyte
+	const totalBytes = 2 * bps
+
+	limiter := rate.NewLimiter(rate.Limit(bps), bps)
+	source := &shortReader{remaining: totalBytes, chunk: 37}
+	lr := NewLimitedReader(source, limiter)
+
+	buffer := make([]byte, totalBytes)
+	start := time.Now()
+	n, err := lr.Read(buffer)
+	elapsed := time.Since(start)
+
+	require.NoError(t, err)
+	require.Equal(t, totalBytes, n)
+
+	// The limiter's burst is pre-filled, so the first `bps` bytes are effectively free; only the remainder
+	// is paced at bps bytes/sec.
+	expected := float64(totalBytes-bps) / bps
+	tolerance := 0.3 * expected
+	assert.InDelta(t, expected, elapsed.Seconds(), tolerance,
+		"measured duration should converge to the configured %d bps cap even though the source returns short reads", bps)
+}
+
+// TestLimitedReader_ShortReads_ContextCancelledMidChunk verifies that bytes already delivered by a short read
+// are preserved in n when the limiter wait for that same chunk is interrupted by context cancellation, rather
+// than being silently dropped from the stream.
+func TestLimitedReader_ShortReads_ContextCancelledMidChunk(t *testing.T) {
+	const burst = 64
+	limiter := rate.NewLimiter(rate.Limit(1), burst) // burst tokens available instantly, then ~1 byte/sec
+	source := &shortReader{remaining: 10 * burst, chunk: 37}
+	lr := NewLimitedReader(source, limiter)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	buffer := make([]byte, 10*burst)
+	n, err := lr.ReadContext(ctx, buffer)
+
+	require.ErrorIs(t, err, context.Canceled)
+	assert.Greater(t, n, 0, "bytes delivered by the underlying reader before cancellation must not be dropped")
+	assert.Less(t, n, len(buffer), "read should not have completed before the context was cancelled")
+}
+
+// TestLimitedReader_ShortReads_MultiLimiterChainConvergesWithLowBpsSharedLimiter guards against
+// computeBufferSize collapsing to a 0-byte buffer when a shared (non-first) limiter in the chain is
+// configured below the ~10KB/s threshold used to divide its burst - a perfectly ordinary group or global
+// bandwidth setting. A 0-byte buffer would make ReadContext spin forever instead of reading and pacing, so
+// this bounds the call with a context deadline well above the expected duration and asserts it still
+// completes.
+func TestLimitedReader_ShortReads_MultiLimiterChainConvergesWithLowBpsSharedLimiter(t *testing.T) {
+	const pcBps = 1 * megabyte
+	const sharedBps = 5000 // below the 10000 division threshold in computeBufferSize
+	const totalBytes = 2 * sharedBps
+
+	pcLimiter := rate.NewLimiter(rate.Limit(pcBps), pcBps)
+	sharedLimiter := rate.NewLimiter(rate.Limit(sharedBps), sharedBps)
+	source := &shortReader{remaining: totalBytes, chunk: 37}
+	lr := NewLimitedReader(source, pcLimiter, sharedLimiter)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	buffer := make([]byte, totalBytes)
+	start := time.Now()
+	n, err := lr.ReadContext(ctx, buffer)
+	elapsed := time.Since(start)
+
+	require.NoError(t, err)
+	require.Equal(t, totalBytes, n)
+
+	// The shared limiter's burst is pre-filled, so the first sharedBps bytes are effectively free; only the
+	// remainder is paced at sharedBps bytes/sec, the slower of the two limiters in the chain.
+	expected := float64(totalBytes-sharedBps) / sharedBps
+	tolerance := 0.3 * expected
+	assert.InDelta(t, expected, elapsed.Seconds(), tolerance,
+		"measured duration should converge to the shared limiter's %d bps cap instead of hanging", sharedBps)
+}
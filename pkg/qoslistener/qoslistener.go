@@ -1,6 +1,7 @@
 package qoslistener
 
 import (
+	"context"
 	"math"
 	"net"
 	"sync"
@@ -11,16 +12,43 @@ import (
 
 const (
 	AllowAllTraffic = -1
+
+	// maxSingleWriteSize caps how many bytes a single rate limiter wait may request at once, so one
+	// connection issuing a large Read/Write cannot starve every other connection waiting on the same
+	// global bucket.
+	maxSingleWriteSize = 8 * 1024
 )
 
+// GroupClassifier is used to derive a group name from an accepted net.Conn. Connections that map to the
+// same group name share a single pair of group rate.Limiters, independent of the global and per-connection
+// limiters. A classifier returning "" opts the connection out of group limiting entirely.
+type GroupClassifier func(net.Conn) string
+
+// groupLimiters holds the read and write rate.Limiter pair shared by every connection classified under the
+// same group name.
+type groupLimiters struct {
+	read  *rate.Limiter
+	write *rate.Limiter
+}
+
 // QoSListener struct implements net.Listener interface and is the wrapper over watchedListener that allows to
 // rate limit bandwidth.
 //
-// There are two rate.Limiter instances used by single QoSListener:
-// - pcLimiter which is per-connection rate limiter and is independent per connection. Access here is not synchronized.
-//   pcLimiter bandwidth size is limited to 2147483647 bytes as value is stored in int32.
-// - globalLimiter which is per-listener rate limiter and is shared between different connections. That one is
-//   synchronized.
+// Read and write traffic are budgeted independently, each through three kinds of rate.Limiter:
+// - pcReadLimiter/pcWriteLimiter which are per-connection rate limiters and are independent per connection.
+//   Access here is not synchronized. Bandwidth size is limited to 2147483647 bytes as value is stored in int32.
+// - a named group limiter pair, shared between connections that GroupClassifier maps to the same name (e.g. peers
+//   on the same remote IP, or a custom grouping supplied by the caller). Groups are created lazily via
+//   SetGroupLimits and apply the same bps to both directions.
+// - globalReadLimiter/globalWriteLimiter which are per-listener rate limiters and are shared between different
+//   connections. rate.Limiter is already safe for concurrent use, so these are held behind an atomic.Pointer
+//   rather than a mutex: SetDirectionalLimits swaps in a brand new *rate.Limiter and readers load-and-use it
+//   without ever blocking on a lock.
+//
+// A connection waits on its per-connection limiter, then its group limiter (if any), then the global limiter for
+// the direction of the operation, unless it is classified as LAN traffic and SetLANExempt has been enabled, in
+// which case both the group and global limiters are bypassed, matching the common expectation that rate limits
+// only apply to WAN traffic.
 //
 // Example usage:
 //    func myLimitedListener(l net.Listener, limitGlobal, limitPerConn int) net.Listener {
@@ -29,18 +57,46 @@ const (
 //      return limited
 //    }
 type QoSListener struct {
-	watchedListener net.Listener
-	globalLimiter   *rate.Limiter
-	pcBandwidth     int32
-	rwMutex         sync.RWMutex
+	watchedListener    net.Listener
+	globalReadLimiter  atomic.Pointer[rate.Limiter]
+	globalWriteLimiter atomic.Pointer[rate.Limiter]
+	pcReadBandwidth    int32
+	pcWriteBandwidth   int32
+
+	groups      map[string]*groupLimiters
+	groupsMutex sync.RWMutex
+
+	classifier     GroupClassifier
+	classifierLock sync.RWMutex
+
+	lanNets   []*net.IPNet
+	lanExempt bool
+	lanMutex  sync.RWMutex
+
+	conns      map[*qosconn]struct{}
+	connsMutex sync.RWMutex
+
+	closedBytesRead    uint64
+	closedBytesWritten uint64
+
+	shutdownCtx    context.Context
+	shutdownCancel context.CancelFunc
 }
 
 func NewListener(listener net.Listener) *QoSListener {
-	return &QoSListener{
-		watchedListener: listener,
-		globalLimiter:   rate.NewLimiter(rate.Limit(math.MaxFloat64), 0),
-		pcBandwidth:     int32(AllowAllTraffic),
+	shutdownCtx, shutdownCancel := context.WithCancel(context.Background())
+	l := &QoSListener{
+		watchedListener:  listener,
+		pcReadBandwidth:  int32(AllowAllTraffic),
+		pcWriteBandwidth: int32(AllowAllTraffic),
+		groups:           make(map[string]*groupLimiters),
+		conns:            make(map[*qosconn]struct{}),
+		shutdownCtx:      shutdownCtx,
+		shutdownCancel:   shutdownCancel,
 	}
+	l.globalReadLimiter.Store(rate.NewLimiter(rate.Limit(math.MaxFloat64), 0))
+	l.globalWriteLimiter.Store(rate.NewLimiter(rate.Limit(math.MaxFloat64), 0))
+	return l
 }
 
 func (l *QoSListener) Accept() (net.Conn, error) {
@@ -48,32 +104,143 @@ func (l *QoSListener) Accept() (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	return newConn(conn, l, atomic.LoadInt32(&l.pcBandwidth)), nil
+	groupName := l.classify(conn)
+	qc := newConn(conn, l, atomic.LoadInt32(&l.pcReadBandwidth), atomic.LoadInt32(&l.pcWriteBandwidth), groupName, l.isLANConn(conn))
+	l.trackConn(qc)
+	return qc, nil
 }
 
 func (l *QoSListener) Close() error {
 	return l.watchedListener.Close()
 }
 
+// Shutdown closes the underlying listener and cancels the shared context every accepted connection waits on
+// while rate limited, so a connection parked in WaitN unwinds promptly instead of leaking a goroutine. ctx
+// bounds how long Shutdown waits for the underlying listener's Close to return.
+func (l *QoSListener) Shutdown(ctx context.Context) error {
+	l.shutdownCancel()
+	closed := make(chan error, 1)
+	go func() {
+		closed <- l.watchedListener.Close()
+	}()
+	select {
+	case err := <-closed:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func (l *QoSListener) Addr() net.Addr {
 	return l.watchedListener.Addr()
 }
 
-func (l *QoSListener) lockLim() {
-	l.rwMutex.Lock()
+// SetLimits method is exposed to allow setting and changing bandwidth limits at runtime.
+// It creates new listener-limiters and saves values of connection-bytes-per-second that is shared
+// between all connections. It applies globalBps/connectionBps symmetrically to both read and write
+// traffic; use SetDirectionalLimits to budget them independently.
+func (l *QoSListener) SetLimits(globalBps, connectionBps int) {
+	l.SetDirectionalLimits(globalBps, globalBps, connectionBps, connectionBps)
 }
 
-func (l *QoSListener) unlockLim() {
-	l.rwMutex.Unlock()
+// SetDirectionalLimits is exposed to allow setting and changing read and write bandwidth limits independently,
+// at runtime. It atomically swaps in a new *rate.Limiter for each direction - readers never block on a lock to
+// pick it up - and saves the connection-bytes-per-second values shared between all connections.
+func (l *QoSListener) SetDirectionalLimits(globalRxBps, globalTxBps, connRxBps, connTxBps int) {
+	l.globalReadLimiter.Store(rate.NewLimiter(findLimit(globalRxBps), findBurst(globalRxBps)))
+	l.globalWriteLimiter.Store(rate.NewLimiter(findLimit(globalTxBps), findBurst(globalTxBps)))
+	atomic.StoreInt32(&l.pcReadBandwidth, int32(connRxBps))
+	atomic.StoreInt32(&l.pcWriteBandwidth, int32(connTxBps))
 }
 
-// SetLimits method is exposed to allow setting and changing bandwidth limits at runtime.
-// It creates new listener-limiter and saves values of connection-bytes-per-second that is shared
-// between all connections.
-func (l *QoSListener) SetLimits(globalBps, connectionBps int) {
-	l.rwMutex.Lock()
-	l.globalLimiter.SetBurst(findBurst(globalBps))
-	l.globalLimiter.SetLimit(findLimit(globalBps))
-	l.rwMutex.Unlock()
-	atomic.StoreInt32(&l.pcBandwidth, int32(connectionBps))
+// SetGroupLimits sets (or creates, on first use) the shared rate limit for every connection classified under
+// name by the configured GroupClassifier, applying bps to both the read and write direction. Passing
+// AllowAllTraffic as bps removes the limit for that group. Changes apply immediately to connections already
+// in that group; none are dropped.
+func (l *QoSListener) SetGroupLimits(name string, bps int) {
+	l.groupsMutex.Lock()
+	defer l.groupsMutex.Unlock()
+	group, ok := l.groups[name]
+	if !ok {
+		l.groups[name] = &groupLimiters{
+			read:  rate.NewLimiter(findLimit(bps), findBurst(bps)),
+			write: rate.NewLimiter(findLimit(bps), findBurst(bps)),
+		}
+		return
+	}
+	group.read.SetLimit(findLimit(bps))
+	group.read.SetBurst(findBurst(bps))
+	group.write.SetLimit(findLimit(bps))
+	group.write.SetBurst(findBurst(bps))
+}
+
+// SetGroupClassifier installs the hook used by Accept to derive a group name for each newly accepted
+// connection. Passing nil disables group classification, so no connection is assigned to a group.
+func (l *QoSListener) SetGroupClassifier(classifier GroupClassifier) {
+	l.classifierLock.Lock()
+	l.classifier = classifier
+	l.classifierLock.Unlock()
+}
+
+// SetLANExempt configures the CIDR ranges treated as LAN and whether connections classified as LAN should
+// bypass both the group and global limiters, mirroring Syncthing's limitsLAN behavior. Per-connection limits
+// still apply to exempt connections.
+func (l *QoSListener) SetLANExempt(cidrs []*net.IPNet, exempt bool) {
+	l.lanMutex.Lock()
+	l.lanNets = cidrs
+	l.lanExempt = exempt
+	l.lanMutex.Unlock()
+}
+
+// classify runs the configured GroupClassifier, if any, against conn and returns the resulting group name.
+func (l *QoSListener) classify(conn net.Conn) string {
+	l.classifierLock.RLock()
+	classifier := l.classifier
+	l.classifierLock.RUnlock()
+	if classifier == nil {
+		return ""
+	}
+	return classifier(conn)
+}
+
+// isLANConn reports whether conn's remote address falls within one of the CIDR ranges configured via
+// SetLANExempt, and LAN exemption is currently enabled.
+func (l *QoSListener) isLANConn(conn net.Conn) bool {
+	l.lanMutex.RLock()
+	defer l.lanMutex.RUnlock()
+	if !l.lanExempt || len(l.lanNets) == 0 {
+		return false
+	}
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		host = conn.RemoteAddr().String()
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range l.lanNets {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// groupLimiter returns the read or write rate.Limiter registered for name via SetGroupLimits, or nil if no
+// limit has been set for that group (in which case the group is unlimited in that direction).
+func (l *QoSListener) groupLimiter(name string, op operation) *rate.Limiter {
+	if name == "" {
+		return nil
+	}
+	l.groupsMutex.RLock()
+	defer l.groupsMutex.RUnlock()
+	group, ok := l.groups[name]
+	if !ok {
+		return nil
+	}
+	if op == opRead {
+		return group.read
+	}
+	return group.write
 }
@@ -0,0 +1,100 @@
+package qoslistener
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnStats is a point-in-time snapshot of a single connection's byte counters, as tracked by qosconn.
+type ConnStats struct {
+	RemoteAddr   string
+	BytesRead    uint64
+	BytesWritten uint64
+	LastActivity time.Time
+}
+
+// Stats is a point-in-time snapshot returned by QoSListener.Stats, aggregating totals across both live and
+// already-closed connections, plus a per-connection breakdown for the connections still open.
+type Stats struct {
+	TotalBytesRead    uint64
+	TotalBytesWritten uint64
+	Connections       []ConnStats
+}
+
+// Observer is implemented by callers that want to be notified of periodic Stats snapshots, e.g. to feed a
+// Prometheus collector or perfstats-style logging.
+type Observer interface {
+	ObserveStats(Stats)
+}
+
+// RegisterObserver starts a goroutine that calls o.ObserveStats with the listener's current Stats every
+// interval, until the returned stop function is called. Stopping is safe to call more than once.
+func (l *QoSListener) RegisterObserver(o Observer, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	var stopOnce sync.Once
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				o.ObserveStats(l.Stats())
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() {
+		stopOnce.Do(func() {
+			close(done)
+		})
+	}
+}
+
+// Stats aggregates the byte counters of every connection this listener has ever accepted: live connections
+// are read directly, already-closed connections are folded into the totals at Close time.
+func (l *QoSListener) Stats() Stats {
+	l.connsMutex.RLock()
+	defer l.connsMutex.RUnlock()
+
+	totalRead := atomic.LoadUint64(&l.closedBytesRead)
+	totalWritten := atomic.LoadUint64(&l.closedBytesWritten)
+
+	conns := make([]ConnStats, 0, len(l.conns))
+	for c := range l.conns {
+		cs := ConnStats{
+			RemoteAddr:   c.RemoteAddr().String(),
+			BytesRead:    c.BytesRead(),
+			BytesWritten: c.BytesWritten(),
+			LastActivity: c.LastActivity(),
+		}
+		conns = append(conns, cs)
+		totalRead += cs.BytesRead
+		totalWritten += cs.BytesWritten
+	}
+
+	return Stats{
+		TotalBytesRead:    totalRead,
+		TotalBytesWritten: totalWritten,
+		Connections:       conns,
+	}
+}
+
+// trackConn registers c as live so it is included in Stats until untrackConn is called.
+func (l *QoSListener) trackConn(c *qosconn) {
+	l.connsMutex.Lock()
+	l.conns[c] = struct{}{}
+	l.connsMutex.Unlock()
+}
+
+// untrackConn removes c from the live set and folds its final byte counts into the closed-connection totals.
+func (l *QoSListener) untrackConn(c *qosconn) {
+	l.connsMutex.Lock()
+	delete(l.conns, c)
+	l.connsMutex.Unlock()
+	atomic.AddUint64(&l.closedBytesRead, c.BytesRead())
+	atomic.AddUint64(&l.closedBytesWritten, c.BytesWritten())
+}
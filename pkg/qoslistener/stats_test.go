@@ -0,0 +1,59 @@
+package qoslistener
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQoSListener_Stats_AggregatesLiveAndClosedConnections(t *testing.T) {
+	parent := newTestParent(t, AllowAllTraffic, AllowAllTraffic)
+	qc, _ := newTestConn(t, parent, int32(AllowAllTraffic), int32(AllowAllTraffic))
+	parent.trackConn(qc)
+
+	data := make([]byte, 4*kilobyte)
+	n, err := qc.Write(data)
+	require.NoError(t, err)
+	require.Equal(t, len(data), n)
+
+	stats := parent.Stats()
+	require.Len(t, stats.Connections, 1)
+	assert.EqualValues(t, len(data), stats.Connections[0].BytesWritten)
+	assert.EqualValues(t, len(data), stats.TotalBytesWritten)
+	assert.False(t, stats.Connections[0].LastActivity.IsZero())
+
+	require.NoError(t, qc.Close())
+
+	stats = parent.Stats()
+	assert.Empty(t, stats.Connections, "Close should remove the connection from the live set")
+	assert.EqualValues(t, len(data), stats.TotalBytesWritten, "bytes written before Close must still be reflected in the totals")
+}
+
+func TestQoSListener_RegisterObserver_PeriodicallyReportsStats(t *testing.T) {
+	parent := newTestParent(t, AllowAllTraffic, AllowAllTraffic)
+
+	snapshots := make(chan Stats, 8)
+	observer := observerFunc(func(s Stats) { snapshots <- s })
+	stop := parent.RegisterObserver(observer, 10*time.Millisecond)
+
+	select {
+	case <-snapshots:
+	case <-time.After(1 * time.Second):
+		t.Fatal("RegisterObserver did not report any Stats snapshot in time")
+	}
+	select {
+	case <-snapshots:
+	case <-time.After(1 * time.Second):
+		t.Fatal("RegisterObserver did not report a second Stats snapshot in time")
+	}
+
+	stop()
+	stop() // stopping twice must not panic
+}
+
+// observerFunc adapts a plain function to the Observer interface.
+type observerFunc func(Stats)
+
+func (f observerFunc) ObserveStats(s Stats) { f(s) }